@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Auth validates inbound proxy authentication before a request is allowed
+// to reach handleRequest. Implementations that deny a request are
+// responsible for writing the denial response (including any
+// Proxy-Authenticate challenge) to w when w is non-nil.
+type Auth interface {
+	Validate(w http.ResponseWriter, req *http.Request) bool
+}
+
+// ListenerAuth is implemented by Auth schemes that additionally require
+// client-certificate verification at the TLS listener boundary (the
+// cert:// scheme). The returned pool is wired into the listener's
+// tls.Config as ClientCAs.
+type ListenerAuth interface {
+	Auth
+	TLSClientCAs() *x509.CertPool
+}
+
+// NewAuth constructs an Auth from a URL-shaped parameter string, e.g.
+// "none://", "static://?username=u&password=p",
+// "basicfile://?path=/etc/htpasswd&reload=60s", or
+// "cert://?ca=/path/ca.pem&allowed_cn=client1,client2".
+func NewAuth(paramstr string) (Auth, error) {
+	if paramstr == "" {
+		return noneAuth{}, nil
+	}
+	u, err := url.Parse(paramstr)
+	if err != nil {
+		return nil, fmt.Errorf("parse auth param: %w", err)
+	}
+	q := u.Query()
+
+	switch u.Scheme {
+	case "", "none":
+		return noneAuth{}, nil
+
+	case "static":
+		username := q.Get("username")
+		password := q.Get("password")
+		if username == "" {
+			return nil, fmt.Errorf("static auth: missing username")
+		}
+		return &staticAuth{username: username, password: password}, nil
+
+	case "basicfile":
+		path := q.Get("path")
+		if path == "" {
+			return nil, fmt.Errorf("basicfile auth: missing path")
+		}
+		reload := 60 * time.Second
+		if raw := q.Get("reload"); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil {
+				return nil, fmt.Errorf("basicfile auth: parse reload: %w", err)
+			}
+			reload = d
+		}
+		return newBasicFileAuth(path, reload)
+
+	case "cert":
+		caPath := q.Get("ca")
+		if caPath == "" {
+			return nil, fmt.Errorf("cert auth: missing ca")
+		}
+		pool, err := loadCertPool(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("cert auth: %w", err)
+		}
+		a := &certAuth{pool: pool}
+		if raw := q.Get("allowed_cn"); raw != "" {
+			a.allowedCN = map[string]bool{}
+			for _, cn := range strings.Split(raw, ",") {
+				a.allowedCN[strings.TrimSpace(cn)] = true
+			}
+		}
+		return a, nil
+
+	default:
+		return nil, fmt.Errorf("unknown auth scheme %q", u.Scheme)
+	}
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+func requireProxyAuth(w http.ResponseWriter, realm string) {
+	if w == nil {
+		return
+	}
+	w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+	w.WriteHeader(http.StatusProxyAuthRequired)
+}
+
+// headerRecorder captures the status and headers an Auth implementation
+// would have written to a real http.ResponseWriter. The goproxy request
+// path has no ResponseWriter of its own, so handleRequest uses one of
+// these to translate a failed Validate call into a goproxy response.
+type headerRecorder struct {
+	header http.Header
+	status int
+}
+
+func newHeaderRecorder() *headerRecorder {
+	return &headerRecorder{header: http.Header{}}
+}
+
+func (h *headerRecorder) Header() http.Header         { return h.header }
+func (h *headerRecorder) Write(b []byte) (int, error) { return len(b), nil }
+func (h *headerRecorder) WriteHeader(status int)      { h.status = status }
+
+// noneAuth allows every request. It is the default when -auth is unset.
+type noneAuth struct{}
+
+func (noneAuth) Validate(http.ResponseWriter, *http.Request) bool { return true }
+
+// staticAuth checks a single fixed username/password pair sent via HTTP
+// Basic auth in the Proxy-Authorization header.
+type staticAuth struct {
+	username string
+	password string
+}
+
+func (a *staticAuth) Validate(w http.ResponseWriter, req *http.Request) bool {
+	username, password, ok := parseProxyBasicAuth(req)
+	if ok &&
+		subtle.ConstantTimeCompare([]byte(username), []byte(a.username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) == 1 {
+		return true
+	}
+	requireProxyAuth(w, "mitm-proxy")
+	return false
+}
+
+// basicFileAuth validates against an htpasswd-style file (bcrypt, {SHA},
+// or plaintext password lines), reloaded periodically from disk.
+type basicFileAuth struct {
+	path string
+
+	mu    sync.RWMutex
+	table map[string]string
+}
+
+func newBasicFileAuth(path string, reload time.Duration) (*basicFileAuth, error) {
+	a := &basicFileAuth{path: path}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	if reload > 0 {
+		go a.reloadLoop(reload)
+	}
+	return a, nil
+}
+
+func (a *basicFileAuth) reloadLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := a.load(); err != nil {
+			log.Printf("%s basicfile auth reload failed path=%q err=%q", time.Now().UTC().Format(time.RFC3339), a.path, err.Error())
+		}
+	}
+}
+
+func (a *basicFileAuth) load() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return fmt.Errorf("open htpasswd: %w", err)
+	}
+	defer f.Close()
+
+	table := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		table[username] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("scan htpasswd: %w", err)
+	}
+
+	a.mu.Lock()
+	a.table = table
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *basicFileAuth) Validate(w http.ResponseWriter, req *http.Request) bool {
+	username, password, ok := parseProxyBasicAuth(req)
+	if ok {
+		a.mu.RLock()
+		hash, found := a.table[username]
+		a.mu.RUnlock()
+		if found && checkHtpasswd(hash, password) {
+			return true
+		}
+	}
+	requireProxyAuth(w, "mitm-proxy")
+	return false
+}
+
+func checkHtpasswd(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		encoded := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(encoded), []byte(strings.TrimPrefix(hash, "{SHA}"))) == 1
+	default:
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1
+	}
+}
+
+func parseProxyBasicAuth(req *http.Request) (username, password string, ok bool) {
+	header := req.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if !strings.HasPrefix(header, prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, prefix))
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok = strings.Cut(string(decoded), ":")
+	return username, password, ok
+}
+
+// certAuth relies on mTLS at the listener: a client that completed the
+// TLS handshake has already proven possession of a certificate signed by
+// pool. Validate only narrows that down to an optional CN allowlist.
+type certAuth struct {
+	pool      *x509.CertPool
+	allowedCN map[string]bool
+}
+
+func (a *certAuth) Validate(w http.ResponseWriter, req *http.Request) bool {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		if w != nil {
+			http.Error(w, "client certificate required", http.StatusProxyAuthRequired)
+		}
+		return false
+	}
+	if a.allowedCN == nil {
+		return true
+	}
+	cn := req.TLS.PeerCertificates[0].Subject.CommonName
+	if a.allowedCN[cn] {
+		return true
+	}
+	if w != nil {
+		http.Error(w, "client certificate not permitted", http.StatusProxyAuthRequired)
+	}
+	return false
+}
+
+func (a *certAuth) TLSClientCAs() *x509.CertPool { return a.pool }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"container/list"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// certSafetyWindow is subtracted from a generated leaf's NotAfter so the
+// cache never hands out a certificate that is about to expire mid-request.
+const certSafetyWindow = 5 * time.Minute
+
+// certCacheJanitorInterval is how often expired entries are swept out of
+// the in-memory cache, independent of Fetch traffic.
+const certCacheJanitorInterval = time.Minute
+
+type certCacheEntry struct {
+	cert       *tls.Certificate
+	expiration time.Time
+}
+
+// certCache is a bounded, expiring, optionally disk-backed store of
+// generated MITM leaf certificates. It implements goproxy's CertStore
+// interface. Entries are keyed by SNI hostname, evicted LRU-first once
+// maxSize is exceeded, and persisted to dir (when set) as PEM-encoded
+// {leaf, key} pairs so a restart doesn't re-mint every cert from scratch.
+type certCache struct {
+	ttl     time.Duration
+	maxSize int
+	dir     string
+	logf    func(format string, args ...any)
+
+	mu      sync.Mutex
+	entries map[string]certCacheEntry
+	order   *list.List
+	elems   map[string]*list.Element
+}
+
+func newCertCache(ttl time.Duration, maxSize int, dir string, logf func(format string, args ...any)) (*certCache, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("create cert cache dir: %w", err)
+		}
+	}
+	cc := &certCache{
+		ttl:     ttl,
+		maxSize: maxSize,
+		dir:     dir,
+		logf:    logf,
+		entries: map[string]certCacheEntry{},
+		order:   list.New(),
+		elems:   map[string]*list.Element{},
+	}
+	go cc.janitorLoop()
+	return cc, nil
+}
+
+func (cc *certCache) janitorLoop() {
+	ticker := time.NewTicker(certCacheJanitorInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		cc.sweep()
+	}
+}
+
+func (cc *certCache) sweep() {
+	now := time.Now()
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for hostname, entry := range cc.entries {
+		if now.After(entry.expiration) {
+			cc.removeLocked(hostname)
+		}
+	}
+}
+
+func (cc *certCache) removeLocked(hostname string) {
+	delete(cc.entries, hostname)
+	if elem, ok := cc.elems[hostname]; ok {
+		cc.order.Remove(elem)
+		delete(cc.elems, hostname)
+	}
+}
+
+func (cc *certCache) touchLocked(hostname string) {
+	if elem, ok := cc.elems[hostname]; ok {
+		cc.order.MoveToFront(elem)
+		return
+	}
+	cc.elems[hostname] = cc.order.PushFront(hostname)
+}
+
+func (cc *certCache) evictTailLocked() {
+	for cc.maxSize > 0 && cc.order.Len() > cc.maxSize {
+		tail := cc.order.Back()
+		if tail == nil {
+			return
+		}
+		hostname := tail.Value.(string)
+		cc.order.Remove(tail)
+		delete(cc.elems, hostname)
+		delete(cc.entries, hostname)
+	}
+}
+
+// Fetch returns the cached certificate for hostname, loading it from disk
+// or generating a fresh one via gen on a full miss.
+func (cc *certCache) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	cc.mu.Lock()
+	if entry, ok := cc.entries[hostname]; ok {
+		if time.Now().Before(entry.expiration) {
+			cc.touchLocked(hostname)
+			cc.mu.Unlock()
+			return entry.cert, nil
+		}
+		cc.removeLocked(hostname)
+	}
+	cc.mu.Unlock()
+
+	if cc.dir != "" {
+		if cert, expiration, err := cc.loadFromDisk(hostname); err == nil && time.Now().Before(expiration) {
+			cc.store(hostname, cert, expiration)
+			return cert, nil
+		}
+	}
+
+	cert, err := gen()
+	if err != nil {
+		return nil, err
+	}
+	expiration, err := cc.expirationOf(cert)
+	if err != nil {
+		return nil, fmt.Errorf("determine cert expiration: %w", err)
+	}
+
+	if cc.dir != "" {
+		if err := cc.saveToDisk(hostname, cert); err != nil {
+			cc.logf("CERTCACHE_SAVE_ERROR hostname=%q err=%q", hostname, err.Error())
+		}
+	}
+
+	cc.store(hostname, cert, expiration)
+	return cert, nil
+}
+
+func (cc *certCache) store(hostname string, cert *tls.Certificate, expiration time.Time) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.entries[hostname] = certCacheEntry{cert: cert, expiration: expiration}
+	cc.touchLocked(hostname)
+	cc.evictTailLocked()
+}
+
+// expirationOf derives the cache expiration for a freshly generated
+// certificate: its NotAfter minus certSafetyWindow, capped by cc.ttl.
+func (cc *certCache) expirationOf(cert *tls.Certificate) (time.Time, error) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return time.Time{}, err
+		}
+		leaf = parsed
+	}
+	expiration := leaf.NotAfter.Add(-certSafetyWindow)
+	if cc.ttl > 0 {
+		if capped := time.Now().Add(cc.ttl); capped.Before(expiration) {
+			expiration = capped
+		}
+	}
+	return expiration, nil
+}
+
+func (cc *certCache) diskPath(hostname string) string {
+	return filepath.Join(cc.dir, hostname+".pem")
+}
+
+func (cc *certCache) loadFromDisk(hostname string) (*tls.Certificate, time.Time, error) {
+	raw, err := os.ReadFile(cc.diskPath(hostname))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var certPEM []byte
+	var keyPEM []byte
+	rest := raw
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		encoded := pem.EncodeToMemory(block)
+		if block.Type == "PRIVATE KEY" || block.Type == "RSA PRIVATE KEY" || block.Type == "EC PRIVATE KEY" {
+			keyPEM = encoded
+		} else {
+			certPEM = append(certPEM, encoded...)
+		}
+	}
+	if len(certPEM) == 0 || len(keyPEM) == 0 {
+		return nil, time.Time{}, fmt.Errorf("incomplete PEM pair on disk for %s", hostname)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("parse stored keypair: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("parse stored leaf: %w", err)
+	}
+	cert.Leaf = leaf
+
+	expiration := leaf.NotAfter.Add(-certSafetyWindow)
+	if cc.ttl > 0 {
+		if capped := time.Now().Add(cc.ttl); capped.Before(expiration) {
+			expiration = capped
+		}
+	}
+	return &cert, expiration, nil
+}
+
+func (cc *certCache) saveToDisk(hostname string, cert *tls.Certificate) error {
+	var buf []byte
+	for _, der := range cert.Certificate {
+		buf = append(buf, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("marshal private key: %w", err)
+	}
+	buf = append(buf, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+
+	tmp, err := os.CreateTemp(cc.dir, "cert-*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("write temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Rename(tmpPath, cc.diskPath(hostname)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("rename temp file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dumpHarFlushInterval and dumpHarFlushEntries bound how long a HAR log
+// can accumulate in memory before it is written out.
+const (
+	dumpHarFlushInterval = time.Hour
+	dumpHarFlushEntries  = 500
+)
+
+// Dumper taps the full request/response pair handleRequest just produced,
+// independent of whatever the transform service decided to do with it.
+type Dumper interface {
+	Dump(req *http.Request, rawBody []byte, status int, headers map[string][]string, respBody []byte, duration time.Duration)
+	Close() error
+}
+
+// NewDumper builds a Dumper that writes into dir in the given format
+// ("text", "har", or "jsonl"). bodyLimit caps how many body bytes are
+// captured per side; allowBinary permits capturing non-text MIME bodies.
+func NewDumper(dir, format string, bodyLimit int, allowBinary bool) (Dumper, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create dump dir: %w", err)
+	}
+	limits := dumpLimits{bodyBytes: bodyLimit, allowBinary: allowBinary}
+	switch format {
+	case "", "text":
+		return newTextDumper(dir, limits)
+	case "jsonl":
+		return newJSONLDumper(dir, limits)
+	case "har":
+		return newHARDumper(dir, limits)
+	default:
+		return nil, fmt.Errorf("unknown dump format %q", format)
+	}
+}
+
+type dumpLimits struct {
+	bodyBytes   int
+	allowBinary bool
+}
+
+// capture trims body to the configured limit and returns it unless its
+// MIME type is binary and binary capture is disallowed.
+func (l dumpLimits) capture(contentType string, body []byte) []byte {
+	if !l.allowBinary && isBinaryMIME(contentType) {
+		return nil
+	}
+	if l.bodyBytes > 0 && len(body) > l.bodyBytes {
+		return body[:l.bodyBytes]
+	}
+	return body
+}
+
+func isBinaryMIME(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	}
+	mediaType = strings.ToLower(mediaType)
+	switch {
+	case mediaType == "":
+		return false
+	case strings.HasPrefix(mediaType, "text/"):
+		return false
+	case strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return false
+	case mediaType == "application/json", mediaType == "application/xml",
+		mediaType == "application/x-www-form-urlencoded", mediaType == "multipart/form-data":
+		return false
+	default:
+		return true
+	}
+}
+
+// decodeContentEncoding reverses gzip/deflate so dumps show readable
+// bodies rather than compressed bytes.
+func decodeContentEncoding(encoding string, body []byte) []byte {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return body
+		}
+		defer r.Close()
+		decoded, err := io.ReadAll(r)
+		if err != nil {
+			return body
+		}
+		return decoded
+	case "deflate":
+		r := flate.NewReader(bytes.NewReader(body))
+		defer r.Close()
+		decoded, err := io.ReadAll(r)
+		if err != nil {
+			return body
+		}
+		return decoded
+	default:
+		return body
+	}
+}
+
+func headerValue(headers map[string][]string, key string) string {
+	for k, values := range headers {
+		if strings.EqualFold(k, key) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// --- text dumper -----------------------------------------------------
+
+type textDumper struct {
+	mu     sync.Mutex
+	f      *os.File
+	limits dumpLimits
+}
+
+func newTextDumper(dir string, limits dumpLimits) (*textDumper, error) {
+	f, err := os.OpenFile(filepath.Join(dir, "dump.log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open text dump log: %w", err)
+	}
+	return &textDumper{f: f, limits: limits}, nil
+}
+
+func (d *textDumper) Dump(req *http.Request, rawBody []byte, status int, headers map[string][]string, respBody []byte, duration time.Duration) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "=== %s %s %s (duration_ms=%d)\n", time.Now().UTC().Format(time.RFC3339), req.Method, req.URL.String(), duration.Milliseconds())
+	fmt.Fprintf(&b, "--- request headers\n")
+	for key, values := range req.Header {
+		for _, v := range values {
+			fmt.Fprintf(&b, "%s: %s\n", key, v)
+		}
+	}
+	writeDumpBody(&b, "request body", req.Header.Get("Content-Type"), req.Header.Get("Content-Encoding"), rawBody, d.limits)
+
+	fmt.Fprintf(&b, "--- %d %s\n", status, http.StatusText(status))
+	for key, values := range headers {
+		for _, v := range values {
+			fmt.Fprintf(&b, "%s: %s\n", key, v)
+		}
+	}
+	writeDumpBody(&b, "response body", headerValue(headers, "Content-Type"), headerValue(headers, "Content-Encoding"), respBody, d.limits)
+	b.WriteString("\n")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	io.WriteString(d.f, b.String())
+}
+
+func writeDumpBody(b *strings.Builder, label, contentType, contentEncoding string, body []byte, limits dumpLimits) {
+	if len(body) == 0 {
+		return
+	}
+	decoded := decodeContentEncoding(contentEncoding, body)
+	captured := limits.capture(contentType, decoded)
+	if len(captured) == 0 {
+		fmt.Fprintf(b, "--- %s (%d bytes, binary, skipped)\n", label, len(decoded))
+		return
+	}
+
+	fmt.Fprintf(b, "--- %s (%d bytes", label, len(decoded))
+	if len(captured) < len(decoded) {
+		fmt.Fprintf(b, ", truncated to %d", len(captured))
+	}
+	b.WriteString(")\n")
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		fmt.Fprintf(b, "%s\n", captured)
+	case "multipart/form-data":
+		fmt.Fprintf(b, "[multipart/form-data, %d bytes]\n", len(captured))
+	default:
+		b.Write(captured)
+		b.WriteString("\n")
+	}
+}
+
+func (d *textDumper) Close() error { return d.f.Close() }
+
+// --- jsonl dumper ------------------------------------------------------
+
+type jsonlEntry struct {
+	Timestamp       time.Time           `json:"timestamp"`
+	Method          string              `json:"method"`
+	URL             string              `json:"url"`
+	RequestHeaders  map[string][]string `json:"requestHeaders"`
+	RequestBody     string              `json:"requestBodyBase64,omitempty"`
+	Status          int                 `json:"status"`
+	ResponseHeaders map[string][]string `json:"responseHeaders"`
+	ResponseBody    string              `json:"responseBodyBase64,omitempty"`
+	DurationMs      int64               `json:"durationMs"`
+}
+
+type jsonlDumper struct {
+	mu     sync.Mutex
+	f      *os.File
+	enc    *json.Encoder
+	limits dumpLimits
+}
+
+func newJSONLDumper(dir string, limits dumpLimits) (*jsonlDumper, error) {
+	f, err := os.OpenFile(filepath.Join(dir, "dump.jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open jsonl dump log: %w", err)
+	}
+	return &jsonlDumper{f: f, enc: json.NewEncoder(f), limits: limits}, nil
+}
+
+func (d *jsonlDumper) Dump(req *http.Request, rawBody []byte, status int, headers map[string][]string, respBody []byte, duration time.Duration) {
+	entry := jsonlEntry{
+		Timestamp:       time.Now().UTC(),
+		Method:          req.Method,
+		URL:             req.URL.String(),
+		RequestHeaders:  req.Header,
+		Status:          status,
+		ResponseHeaders: headers,
+		DurationMs:      duration.Milliseconds(),
+	}
+	if captured := d.limits.capture(req.Header.Get("Content-Type"), rawBody); len(captured) > 0 {
+		entry.RequestBody = base64.StdEncoding.EncodeToString(captured)
+	}
+	if captured := d.limits.capture(headerValue(headers, "Content-Type"), respBody); len(captured) > 0 {
+		entry.ResponseBody = base64.StdEncoding.EncodeToString(captured)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_ = d.enc.Encode(entry)
+}
+
+func (d *jsonlDumper) Close() error { return d.f.Close() }
+
+// --- HAR dumper ----------------------------------------------------
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+}
+
+type harRequest struct {
+	Method   string         `json:"method"`
+	URL      string         `json:"url"`
+	Headers  []harNameValue `json:"headers"`
+	PostData *harPostData   `json:"postData,omitempty"`
+}
+
+type harResponse struct {
+	Status  int            `json:"status"`
+	Headers []harNameValue `json:"headers"`
+	Content harContent     `json:"content"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+}
+
+type harDumper struct {
+	dir    string
+	limits dumpLimits
+
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+func newHARDumper(dir string, limits dumpLimits) (*harDumper, error) {
+	d := &harDumper{dir: dir, limits: limits}
+	go d.flushLoop()
+	return d, nil
+}
+
+func (d *harDumper) flushLoop() {
+	ticker := time.NewTicker(dumpHarFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		_ = d.flush()
+	}
+}
+
+func (d *harDumper) Dump(req *http.Request, rawBody []byte, status int, headers map[string][]string, respBody []byte, duration time.Duration) {
+	entry := harEntry{
+		StartedDateTime: time.Now().UTC().Format(time.RFC3339),
+		Time:            float64(duration.Microseconds()) / 1000,
+		Request: harRequest{
+			Method:  req.Method,
+			URL:     req.URL.String(),
+			Headers: toHarHeaders(req.Header),
+		},
+		Response: harResponse{
+			Status:  status,
+			Headers: toHarHeaders(headers),
+			Content: d.content(headerValue(headers, "Content-Type"), respBody),
+		},
+	}
+	if captured := d.limits.capture(req.Header.Get("Content-Type"), rawBody); len(captured) > 0 {
+		entry.Request.PostData = &harPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     string(captured),
+		}
+	}
+
+	d.mu.Lock()
+	d.entries = append(d.entries, entry)
+	flushNow := len(d.entries) >= dumpHarFlushEntries
+	d.mu.Unlock()
+
+	if flushNow {
+		_ = d.flush()
+	}
+}
+
+func (d *harDumper) content(contentType string, body []byte) harContent {
+	captured := d.limits.capture(contentType, body)
+	c := harContent{Size: len(body), MimeType: contentType}
+	if len(captured) == 0 {
+		return c
+	}
+	if isBinaryMIME(contentType) {
+		c.Text = base64.StdEncoding.EncodeToString(captured)
+		c.Encoding = "base64"
+	} else {
+		c.Text = string(captured)
+	}
+	return c
+}
+
+func toHarHeaders(headers map[string][]string) []harNameValue {
+	out := make([]harNameValue, 0, len(headers))
+	for key, values := range headers {
+		for _, v := range values {
+			out = append(out, harNameValue{Name: key, Value: v})
+		}
+	}
+	return out
+}
+
+func (d *harDumper) flush() error {
+	d.mu.Lock()
+	entries := d.entries
+	d.entries = nil
+	d.mu.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+
+	doc := struct {
+		Log struct {
+			Version string `json:"version"`
+			Creator struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"creator"`
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}{}
+	doc.Log.Version = "1.2"
+	doc.Log.Creator.Name = "egress-proxy"
+	doc.Log.Creator.Version = "1.0"
+	doc.Log.Entries = entries
+
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("marshal har: %w", err)
+	}
+
+	path := filepath.Join(d.dir, fmt.Sprintf("dump-%d.har", time.Now().UnixNano()))
+	tmp, err := os.CreateTemp(d.dir, "har-*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp har: %w", err)
+	}
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write temp har: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("close temp har: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (d *harDumper) Close() error {
+	return d.flush()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
@@ -15,7 +16,6 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/elazarl/goproxy"
@@ -35,60 +35,69 @@ type transformResponse struct {
 	BodyBase64 string              `json:"bodyBase64,omitempty"`
 }
 
-type certStorage struct {
-	mu    sync.RWMutex
-	certs map[string]*tls.Certificate
-}
-
-func newCertStorage() *certStorage {
-	return &certStorage{certs: map[string]*tls.Certificate{}}
-}
-
-func (cs *certStorage) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
-	cs.mu.RLock()
-	cached, ok := cs.certs[hostname]
-	cs.mu.RUnlock()
-	if ok {
-		return cached, nil
-	}
-
-	cert, err := gen()
-	if err != nil {
-		return nil, err
-	}
-
-	cs.mu.Lock()
-	cs.certs[hostname] = cert
-	cs.mu.Unlock()
-	return cert, nil
-}
-
 type proxyApp struct {
-	transformURL        string
+	transformPool       *TransformPool
 	client              *http.Client
 	logger              *log.Logger
 	logFile             *os.File
 	requestPreviewBytes int
+	auth                Auth
+	dumper              Dumper
+	policy              *Policy
 }
 
-func newProxyApp(transformURL, logPath string, requestPreviewBytes int) (*proxyApp, error) {
+func newProxyApp(transformPool *TransformPool, logPath string, requestPreviewBytes int, auth Auth, dumper Dumper, policy *Policy) (*proxyApp, error) {
 	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
 	if err != nil {
 		return nil, fmt.Errorf("open log file: %w", err)
 	}
 	logger := log.New(io.MultiWriter(os.Stdout, logFile), "", 0)
+	if auth == nil {
+		auth = noneAuth{}
+	}
 	return &proxyApp{
-		transformURL: transformURL,
+		transformPool: transformPool,
 		client: &http.Client{
 			Timeout: 60 * time.Second,
 		},
 		logger:              logger,
 		logFile:             logFile,
 		requestPreviewBytes: requestPreviewBytes,
+		auth:                auth,
+		dumper:              dumper,
+		policy:              policy,
 	}, nil
 }
 
+// checkAuth validates proxy authentication for a request flowing through
+// the goproxy OnRequest chain, which has no http.ResponseWriter of its
+// own. On denial it returns a ready-to-serve goproxy response carrying
+// whatever headers (e.g. Proxy-Authenticate) the Auth wrote.
+func (app *proxyApp) checkAuth(req *http.Request) (*http.Response, bool) {
+	rec := newHeaderRecorder()
+	if app.auth.Validate(rec, req) {
+		return nil, true
+	}
+	app.logf("AUTH_DENY method=%s url=%q remote=%q", req.Method, req.URL.String(), req.RemoteAddr)
+	status := rec.status
+	if status == 0 {
+		status = http.StatusProxyAuthRequired
+	}
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, status, "proxy authentication required")
+	for key, values := range rec.header {
+		for _, value := range values {
+			resp.Header.Add(key, value)
+		}
+	}
+	return resp, false
+}
+
 func (app *proxyApp) close() error {
+	if app.dumper != nil {
+		if err := app.dumper.Close(); err != nil {
+			app.logf("DUMPER_CLOSE_ERROR err=%q", err.Error())
+		}
+	}
 	if app.logFile == nil {
 		return nil
 	}
@@ -151,13 +160,13 @@ func removeHopHeaders(headers map[string][]string) map[string][]string {
 	return out
 }
 
-func (app *proxyApp) callTransform(payload transformRequest) (transformResponse, error) {
+func (app *proxyApp) callTransform(ctx context.Context, transformURL string, payload transformRequest) (transformResponse, error) {
 	body, err := json.Marshal(payload)
 	if err != nil {
 		return transformResponse{}, fmt.Errorf("marshal transform payload: %w", err)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, app.transformURL, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, transformURL, bytes.NewReader(body))
 	if err != nil {
 		return transformResponse{}, fmt.Errorf("build transform request: %w", err)
 	}
@@ -188,7 +197,34 @@ func (app *proxyApp) callTransform(payload transformRequest) (transformResponse,
 	return parsed, nil
 }
 
-func (app *proxyApp) handleRequest(req *http.Request) (*http.Request, *http.Response) {
+// mitmAuthenticated marks a goproxy ProxyCtx (and so every decrypted
+// request that flows through the tunnel it represents) as having already
+// passed Auth.Validate at CONNECT time. handleRequest uses its presence
+// to avoid re-checking auth against a reconstructed MITM request, which
+// carries neither the original Proxy-Authorization header nor req.TLS.
+type mitmAuthenticated struct{}
+
+func (app *proxyApp) handleRequest(req *http.Request, alreadyAuthed bool) (*http.Request, *http.Response) {
+	if !alreadyAuthed {
+		if resp, ok := app.checkAuth(req); !ok {
+			return req, resp
+		}
+	}
+
+	var transformOverride string
+	if app.policy != nil {
+		switch app.policy.Match(req.Host, req.RemoteAddr) {
+		case ActionBlock:
+			app.logf("POLICY_BLOCK method=%s url=%q", req.Method, req.URL.String())
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "blocked by policy")
+		case ActionBypass:
+			app.logf("POLICY_BYPASS method=%s url=%q", req.Method, req.URL.String())
+			return req, nil
+		case ActionTransform:
+			transformOverride = app.policy.TransformURL(req.Host, req.RemoteAddr)
+		}
+	}
+
 	start := time.Now()
 	rawBody := []byte{}
 	if req.Body != nil {
@@ -230,7 +266,13 @@ func (app *proxyApp) handleRequest(req *http.Request) (*http.Request, *http.Resp
 		payload.BodyBase64 = base64.StdEncoding.EncodeToString(rawBody)
 	}
 
-	tr, err := app.callTransform(payload)
+	var tr transformResponse
+	var err error
+	if transformOverride != "" {
+		tr, err = app.callTransform(req.Context(), transformOverride, payload)
+	} else {
+		tr, err = app.callTransformPool(req.Context(), payload)
+	}
 	if err != nil {
 		app.logf("MITM_TRANSFORM_ERROR method=%s url=%q err=%q", req.Method, req.URL.String(), err.Error())
 		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, "transform failed")
@@ -265,32 +307,97 @@ func (app *proxyApp) handleRequest(req *http.Request) (*http.Request, *http.Resp
 	resp.Header.Set("Content-Length", strconv.Itoa(len(decodedBody)))
 	resp.Header.Set("X-Iterate-MITM", "1")
 
+	duration := time.Since(start)
+	if app.dumper != nil {
+		app.dumper.Dump(req, rawBody, tr.Status, tr.Headers, decodedBody, duration)
+	}
+
 	app.logf(
 		"MITM_RESPONSE method=%s url=%q status=%d body_bytes=%d duration_ms=%d",
 		req.Method,
 		req.URL.String(),
 		tr.Status,
 		len(decodedBody),
-		time.Since(start).Milliseconds(),
+		duration.Milliseconds(),
 	)
 	return req, resp
 }
 
 func main() {
 	listenAddr := flag.String("listen", ":18080", "MITM proxy listen address")
-	transformURL := flag.String("transform-url", "http://127.0.0.1:19090/transform", "URL of local transform service")
+	transformURLs := flag.String("transform-urls", "http://127.0.0.1:19090/transform", "comma-separated URLs of the transform service pool")
+	transformHedgeAfter := flag.Duration("transform-hedge-after", 150*time.Millisecond, "how long to wait for the leading transform upstream before hedging to the next")
 	caCertPath := flag.String("ca-cert", "/data/mitm/ca.crt", "Path to CA certificate PEM")
 	caKeyPath := flag.String("ca-key", "/data/mitm/ca.key", "Path to CA private key PEM")
 	logPath := flag.String("log", "/tmp/egress-proxy.log", "Path to append log lines")
 	requestPreviewBytes := flag.Int("request-preview-bytes", 512, "max bytes from request body logged as base64")
+	authParam := flag.String("auth", "none://", "proxy auth scheme: none://, static://?username=&password=, basicfile://?path=&reload=, cert://?ca=")
+	certTTL := flag.Duration("cert-ttl", 12*time.Hour, "max time a generated MITM leaf cert is cached before being regenerated")
+	certCacheSize := flag.Int("cert-cache-size", 1024, "max number of MITM leaf certs held in memory (0 disables eviction)")
+	certCacheDir := flag.String("cert-cache-dir", "", "directory to persist MITM leaf certs across restarts (disabled if empty)")
+	dumpDir := flag.String("dump-dir", "", "directory to write full request/response dumps to (disabled if empty)")
+	dumpFormat := flag.String("dump-format", "text", "dump format: text, har, or jsonl")
+	dumpBodyBytes := flag.Int("dump-body-bytes", 65536, "max body bytes captured per side in a dump")
+	dumpBinary := flag.Bool("dump-binary", false, "capture bodies with a binary MIME type in dumps")
+	policyPath := flag.String("policy", "", "path to a YAML/JSON per-host policy file (bypass/transform/block); reloaded on SIGHUP")
+	tlsListenAddr := flag.String("tls-listen", "", "additional TLS listen address (disabled if empty)")
+	tlsCertPath := flag.String("tls-cert", "", "path to the TLS listener's server certificate PEM (required with -tls-listen)")
+	tlsKeyPath := flag.String("tls-key", "", "path to the TLS listener's server key PEM (required with -tls-listen)")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "minimum TLS version for -tls-listen: 1.2 or 1.3")
+	tlsCiphers := flag.String("tls-ciphers", "", "comma-separated cipher suite names for -tls-listen (default: Go's own preference order)")
+	listCiphers := flag.Bool("list-ciphers", false, "print cipher suite names supported by this Go build and exit")
 	flag.Parse()
 
-	app, err := newProxyApp(*transformURL, *logPath, *requestPreviewBytes)
+	if *listCiphers {
+		for _, name := range ListCipherNames() {
+			fmt.Println(name)
+		}
+		return
+	}
+
+	auth, err := NewAuth(*authParam)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -auth: %v\n", err)
+		os.Exit(1)
+	}
+
+	dumper, err := NewDumper(*dumpDir, *dumpFormat, *dumpBodyBytes, *dumpBinary)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -dump-dir/-dump-format: %v\n", err)
+		os.Exit(1)
+	}
+
+	var policy *Policy
+	if *policyPath != "" {
+		policy, err = LoadPolicy(*policyPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -policy: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var transformURLList []string
+	for _, u := range strings.Split(*transformURLs, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			transformURLList = append(transformURLList, u)
+		}
+	}
+	transformPool, err := NewTransformPool(transformURLList, *transformHedgeAfter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -transform-urls: %v\n", err)
+		os.Exit(1)
+	}
+
+	app, err := newProxyApp(transformPool, *logPath, *requestPreviewBytes, auth, dumper, policy)
 	if err != nil {
 		panic(err)
 	}
 	defer app.close()
 
+	if policy != nil {
+		policy.Watch(app.logf)
+	}
+
 	ca, err := parseCA(*caCertPath, *caKeyPath)
 	if err != nil {
 		app.logf("FATAL failed_to_load_ca err=%q", err.Error())
@@ -298,30 +405,115 @@ func main() {
 	}
 	goproxy.GoproxyCa = ca
 
+	if _, ok := auth.(ListenerAuth); ok {
+		app.logf("AUTH_INFO cert:// auth requires client certs to be verified at the listener; see -tls-listen")
+	}
+
+	certCache, err := newCertCache(*certTTL, *certCacheSize, *certCacheDir, app.logf)
+	if err != nil {
+		app.logf("FATAL failed_to_create_cert_cache err=%q", err.Error())
+		os.Exit(1)
+	}
+
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.Verbose = false
-	proxy.CertStore = newCertStorage()
+	proxy.CertStore = certCache
 	proxy.NonproxyHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		if req.URL.Path == "/healthz" {
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
 			w.WriteHeader(http.StatusOK)
-			_, _ = w.Write([]byte("ok\n"))
+			_ = json.NewEncoder(w).Encode(struct {
+				Status    string             `json:"status"`
+				Upstreams []upstreamSnapshot `json:"upstreams"`
+			}{
+				Status:    "ok",
+				Upstreams: app.transformPool.Healthz(),
+			})
+			return
+		}
+		if !app.auth.Validate(w, req) {
+			app.logf("AUTH_DENY method=%s url=%q remote=%q", req.Method, req.URL.String(), req.RemoteAddr)
 			return
 		}
 		http.Error(w, "proxy endpoint", http.StatusBadRequest)
 	})
-	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
-	proxy.OnRequest().DoFunc(func(req *http.Request, _ *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		return app.handleRequest(req)
+	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		remoteAddr := ""
+		if ctx.Req != nil {
+			remoteAddr = ctx.Req.RemoteAddr
+		}
+		// Auth must be enforced here, at CONNECT time, for every
+		// disposition (MITM and bypass alike): goproxy never sets req.TLS
+		// on the requests it reconstructs off a MITM'd tunnel, and real
+		// HTTP clients only ever send Proxy-Authorization on the CONNECT
+		// that opens the tunnel, never on the opaque bytes after it. This
+		// is the only point in the flow where every request still carries
+		// real headers and TLS state to check. ctx.UserData records the
+		// result so the per-request DoFunc below doesn't re-check a
+		// decrypted request that can no longer prove it.
+		if ctx.Req != nil {
+			rec := newHeaderRecorder()
+			if !app.auth.Validate(rec, ctx.Req) {
+				app.logf("AUTH_DENY host=%q remote=%q", host, remoteAddr)
+				return goproxy.RejectConnect, host
+			}
+			ctx.UserData = mitmAuthenticated{}
+		}
+
+		if policy == nil {
+			return goproxy.MitmConnect, host
+		}
+		switch policy.Match(host, remoteAddr) {
+		case ActionBypass:
+			app.logf("POLICY_BYPASS host=%q", host)
+			return goproxy.OkConnect, host
+		case ActionBlock:
+			app.logf("POLICY_BLOCK host=%q", host)
+			return goproxy.RejectConnect, host
+		default:
+			return goproxy.MitmConnect, host
+		}
+	}))
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		_, alreadyAuthed := ctx.UserData.(mitmAuthenticated)
+		return app.handleRequest(req, alreadyAuthed)
 	})
 
-	app.logf("MITM_BOOT pid=%d listen=%s transform_url=%q", os.Getpid(), *listenAddr, *transformURL)
+	app.logf("MITM_BOOT pid=%d listen=%s transform_urls=%q", os.Getpid(), *listenAddr, *transformURLs)
 	server := &http.Server{
 		Addr:              *listenAddr,
 		Handler:           proxy,
 		ReadHeaderTimeout: 20 * time.Second,
 	}
-	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+
+	serverErrs := make(chan error, 2)
+	go func() { serverErrs <- server.ListenAndServe() }()
+
+	if *tlsListenAddr != "" {
+		if *tlsCertPath == "" || *tlsKeyPath == "" {
+			app.logf("FATAL tls-listen requires -tls-cert and -tls-key")
+			os.Exit(1)
+		}
+		var clientCAs *x509.CertPool
+		if listenerAuth, ok := auth.(ListenerAuth); ok {
+			clientCAs = listenerAuth.TLSClientCAs()
+		}
+		tlsConfig, err := buildTLSListenerConfig(*tlsCertPath, *tlsKeyPath, *tlsMinVersion, *tlsCiphers, clientCAs)
+		if err != nil {
+			app.logf("FATAL failed_to_build_tls_config err=%q", err.Error())
+			os.Exit(1)
+		}
+		tlsServer := &http.Server{
+			Addr:              *tlsListenAddr,
+			Handler:           proxy,
+			TLSConfig:         tlsConfig,
+			ReadHeaderTimeout: 20 * time.Second,
+		}
+		app.logf("MITM_TLS_BOOT listen=%s min_version=%s mtls=%t", *tlsListenAddr, *tlsMinVersion, clientCAs != nil)
+		go func() { serverErrs <- tlsServer.ListenAndServeTLS("", "") }()
+	}
+
+	if err := <-serverErrs; err != nil && !errors.Is(err, http.ErrServerClosed) {
 		app.logf("FATAL server_error err=%q", err.Error())
 		os.Exit(1)
 	}
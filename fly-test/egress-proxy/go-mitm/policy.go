@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Action is the disposition a Policy rule assigns to a matching host.
+type Action string
+
+const (
+	// ActionBypass forwards the CONNECT/request untouched, without MITM
+	// interception or a transform round-trip.
+	ActionBypass Action = "bypass"
+	// ActionTransform is the default: MITM-intercept and send the
+	// decrypted request through the transform service.
+	ActionTransform Action = "transform"
+	// ActionBlock rejects the CONNECT, or answers the HTTP request with
+	// a 403, without contacting the upstream at all.
+	ActionBlock Action = "block"
+)
+
+// PolicyRule is one ordered entry in a policy file. A rule matches when
+// every non-empty matcher it sets (Host, HostRegex, CIDR) matches; a rule
+// with no matchers never matches.
+type PolicyRule struct {
+	Host         string `json:"host,omitempty" yaml:"host,omitempty"`
+	HostRegex    string `json:"host_regex,omitempty" yaml:"host_regex,omitempty"`
+	CIDR         string `json:"cidr,omitempty" yaml:"cidr,omitempty"`
+	Action       Action `json:"action" yaml:"action"`
+	TransformURL string `json:"transform_url,omitempty" yaml:"transform_url,omitempty"`
+}
+
+type policyFile struct {
+	Rules []PolicyRule `json:"rules" yaml:"rules"`
+}
+
+type compiledRule struct {
+	PolicyRule
+	hostRegex *regexp.Regexp
+	cidr      *net.IPNet
+}
+
+// Policy is an ordered set of per-host rules deciding whether a request
+// bypasses MITM, is transformed, or is blocked. Rules are evaluated in
+// file order; the first match wins. Policy is safe for concurrent use and
+// can be hot-reloaded via Watch.
+type Policy struct {
+	path string
+
+	mu    sync.RWMutex
+	rules []compiledRule
+}
+
+// LoadPolicy reads and compiles the policy file at path. JSON is used for
+// a ".json" extension, YAML otherwise.
+func LoadPolicy(path string) (*Policy, error) {
+	p := &Policy{path: path}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Policy) reload() error {
+	raw, err := os.ReadFile(p.path)
+	if err != nil {
+		return fmt.Errorf("read policy file: %w", err)
+	}
+
+	var pf policyFile
+	if strings.HasSuffix(p.path, ".json") {
+		err = json.Unmarshal(raw, &pf)
+	} else {
+		err = yaml.Unmarshal(raw, &pf)
+	}
+	if err != nil {
+		return fmt.Errorf("parse policy file: %w", err)
+	}
+
+	compiled := make([]compiledRule, 0, len(pf.Rules))
+	for i, rule := range pf.Rules {
+		cr := compiledRule{PolicyRule: rule}
+		if rule.HostRegex != "" {
+			re, err := regexp.Compile(rule.HostRegex)
+			if err != nil {
+				return fmt.Errorf("rule %d: compile host_regex: %w", i, err)
+			}
+			cr.hostRegex = re
+		}
+		if rule.CIDR != "" {
+			_, ipnet, err := net.ParseCIDR(rule.CIDR)
+			if err != nil {
+				return fmt.Errorf("rule %d: parse cidr: %w", i, err)
+			}
+			cr.cidr = ipnet
+		}
+		switch rule.Action {
+		case ActionBypass, ActionTransform, ActionBlock:
+		default:
+			return fmt.Errorf("rule %d: unknown action %q", i, rule.Action)
+		}
+		compiled = append(compiled, cr)
+	}
+
+	p.mu.Lock()
+	p.rules = compiled
+	p.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the policy whenever the process receives SIGHUP, so
+// operators can adjust rules without restarting the proxy or dropping
+// in-flight TLS sessions.
+func (p *Policy) Watch(logf func(format string, args ...any)) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if err := p.reload(); err != nil {
+				logf("POLICY_RELOAD_ERROR path=%q err=%q", p.path, err.Error())
+				continue
+			}
+			logf("POLICY_RELOADED path=%q", p.path)
+		}
+	}()
+}
+
+func (p *Policy) matchRule(host, _ string) *compiledRule {
+	hostname := stripPort(host)
+	ip := matchIP(hostname)
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for i := range p.rules {
+		rule := &p.rules[i]
+		if rule.Host == "" && rule.hostRegex == nil && rule.cidr == nil {
+			continue
+		}
+		if rule.Host != "" && !hostGlobMatch(rule.Host, hostname) {
+			continue
+		}
+		if rule.hostRegex != nil && !rule.hostRegex.MatchString(hostname) {
+			continue
+		}
+		if rule.cidr != nil && (ip == nil || !rule.cidr.Contains(ip)) {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+// Match returns the disposition for host (as seen in a CONNECT target or
+// Request.Host, optionally with a port). remoteAddr is accepted but not
+// consulted: CIDR rules are tested against host only (see matchIP).
+// Hosts matching no rule default to ActionTransform.
+func (p *Policy) Match(host, remoteAddr string) Action {
+	if rule := p.matchRule(host, remoteAddr); rule != nil {
+		return rule.Action
+	}
+	return ActionTransform
+}
+
+// TransformURL returns the transform_url override for host, or "" if no
+// rule matched or the matching rule didn't set one.
+func (p *Policy) TransformURL(host, remoteAddr string) string {
+	if rule := p.matchRule(host, remoteAddr); rule != nil {
+		return rule.TransformURL
+	}
+	return ""
+}
+
+func stripPort(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return strings.ToLower(hostport)
+	}
+	return strings.ToLower(host)
+}
+
+// matchIP resolves an IP to test CIDR rules against: the destination host,
+// when it is itself a literal IP (common for CONNECT requests to an
+// IP:port). CIDR rules exist to block egress to internal/RFC1918
+// destinations, so they must be evaluated against the destination, never
+// the client's remoteAddr, which identifies who is calling the proxy, not
+// where the request is going.
+func matchIP(hostname string) net.IP {
+	return net.ParseIP(hostname)
+}
+
+// hostGlobMatch matches pattern against host using rightmost-label
+// wildcards, e.g. "*.googleapis.com" matches "www.googleapis.com" but not
+// "googleapis.com" or "a.b.googleapis.com".
+func hostGlobMatch(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if !strings.Contains(pattern, "*") {
+		return pattern == host
+	}
+
+	patternLabels := strings.Split(pattern, ".")
+	hostLabels := strings.Split(host, ".")
+	if len(patternLabels) != len(hostLabels) {
+		return false
+	}
+	for i, label := range patternLabels {
+		if label == "*" {
+			continue
+		}
+		if label != hostLabels[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var cipherSuiteByName = buildCipherSuiteIndex()
+
+func buildCipherSuiteIndex() map[string]uint16 {
+	idx := map[string]uint16{}
+	for _, cs := range tls.CipherSuites() {
+		idx[cs.Name] = cs.ID
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		idx[cs.Name] = cs.ID
+	}
+	return idx
+}
+
+// ListCipherNames returns every cipher-suite name supported by the
+// current Go build, secure suites first, for -list-ciphers.
+func ListCipherNames() []string {
+	var secure, insecure []string
+	for _, cs := range tls.CipherSuites() {
+		secure = append(secure, cs.Name)
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		insecure = append(insecure, cs.Name+" (insecure)")
+	}
+	sort.Strings(secure)
+	sort.Strings(insecure)
+	return append(secure, insecure...)
+}
+
+func parseTLSMinVersion(raw string) (uint16, error) {
+	switch raw {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported -tls-min-version %q (want 1.2 or 1.3)", raw)
+	}
+}
+
+func parseCipherSuites(raw string) ([]uint16, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var ids []uint16
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := cipherSuiteByName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q (see -list-ciphers)", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// buildTLSListenerConfig assembles the tls.Config for -tls-listen.
+// clientCAs, when non-nil (wired in from a cert:// Auth), enables mTLS
+// termination at the listener boundary.
+func buildTLSListenerConfig(certPath, keyPath, minVersion, ciphers string, clientCAs *x509.CertPool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("load tls listener keypair: %w", err)
+	}
+	version, err := parseTLSMinVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := parseCipherSuites(ciphers)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   version,
+		CipherSuites: suites,
+	}
+	if clientCAs != nil {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = clientCAs
+	}
+	return cfg, nil
+}
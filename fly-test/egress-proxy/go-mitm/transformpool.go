@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// transformEWMAAlpha weights how quickly okDuration tracks recent
+// latencies versus history.
+const transformEWMAAlpha = 0.2
+
+// transformUpstreamStaleAfter is how long a recorded error keeps an
+// upstream classified as "bad", which places it last in pick's order.
+const transformUpstreamStaleAfter = 30 * time.Second
+
+// transformLatencyWindow bounds how many recent latencies are kept per
+// upstream for the p50/p95 counters exposed on /healthz.
+const transformLatencyWindow = 128
+
+type upstreamClass int
+
+const (
+	classUnknown upstreamClass = iota
+	classGood
+	classBad
+)
+
+// upstreamStats tracks recent health for a single transform upstream:
+// an EWMA of successful latencies, the age of its last error, and raw
+// counters plus a recent-latency window for percentile reporting.
+type upstreamStats struct {
+	mu sync.Mutex
+
+	hasDuration bool
+	okDuration  time.Duration
+
+	lastErrorSet bool
+	lastError    time.Time
+
+	successes uint64
+	failures  uint64
+	recent    []time.Duration
+}
+
+func (s *upstreamStats) recordSuccess(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.successes++
+	if !s.hasDuration {
+		s.okDuration = d
+		s.hasDuration = true
+	} else {
+		s.okDuration = time.Duration(transformEWMAAlpha*float64(d) + (1-transformEWMAAlpha)*float64(s.okDuration))
+	}
+	s.lastErrorSet = false
+	s.recent = append(s.recent, d)
+	if len(s.recent) > transformLatencyWindow {
+		s.recent = s.recent[len(s.recent)-transformLatencyWindow:]
+	}
+}
+
+func (s *upstreamStats) recordFailure() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures++
+	s.lastError = time.Now()
+	s.lastErrorSet = true
+}
+
+func (s *upstreamStats) classify(staleAfter time.Duration) upstreamClass {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastErrorSet && time.Since(s.lastError) < staleAfter {
+		return classBad
+	}
+	if s.hasDuration {
+		return classGood
+	}
+	return classUnknown
+}
+
+func (s *upstreamStats) duration() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.okDuration
+}
+
+func (s *upstreamStats) errorAge() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.lastErrorSet {
+		return 0
+	}
+	return time.Since(s.lastError)
+}
+
+type upstreamSnapshot struct {
+	URL     string `json:"url"`
+	Success uint64 `json:"success"`
+	Fail    uint64 `json:"fail"`
+	P50Ms   int64  `json:"p50_ms"`
+	P95Ms   int64  `json:"p95_ms"`
+	Healthy bool   `json:"healthy"`
+}
+
+func (s *upstreamStats) snapshot(url string, staleAfter time.Duration) upstreamSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recent := append([]time.Duration(nil), s.recent...)
+	sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+	percentile := func(p float64) int64 {
+		if len(recent) == 0 {
+			return 0
+		}
+		idx := int(p * float64(len(recent)-1))
+		return recent[idx].Milliseconds()
+	}
+	return upstreamSnapshot{
+		URL:     url,
+		Success: s.successes,
+		Fail:    s.failures,
+		P50Ms:   percentile(0.50),
+		P95Ms:   percentile(0.95),
+		Healthy: !(s.lastErrorSet && time.Since(s.lastError) < staleAfter),
+	}
+}
+
+// TransformPool is a health-aware picker over a set of transform upstream
+// URLs. It tracks per-upstream latency and error rate so callTransformPool
+// can race a few healthy candidates and hedge to the next one if the
+// leader stalls.
+type TransformPool struct {
+	urls       []string
+	hedgeAfter time.Duration
+	staleAfter time.Duration
+
+	stats map[string]*upstreamStats
+}
+
+// NewTransformPool builds a pool over urls. hedgeAfter is how long
+// callTransformPool waits for the leading candidate before dispatching to
+// the next one.
+func NewTransformPool(urls []string, hedgeAfter time.Duration) (*TransformPool, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("transform pool requires at least one upstream URL")
+	}
+	stats := make(map[string]*upstreamStats, len(urls))
+	for _, u := range urls {
+		stats[u] = &upstreamStats{}
+	}
+	return &TransformPool{urls: urls, hedgeAfter: hedgeAfter, staleAfter: transformUpstreamStaleAfter, stats: stats}, nil
+}
+
+// pick orders candidates for a single attempt: the best "good" upstreams
+// first (sorted by ascending EWMA latency, capped at half the pool,
+// rounded up), then upstreams with no recorded successful latency and no
+// recent error, then any remaining good ones, then the ones currently in
+// their error-stale window.
+func (p *TransformPool) pick() []string {
+	var good, unknown, bad []string
+	for _, u := range p.urls {
+		switch p.stats[u].classify(p.staleAfter) {
+		case classGood:
+			good = append(good, u)
+		case classBad:
+			bad = append(bad, u)
+		default:
+			unknown = append(unknown, u)
+		}
+	}
+	sort.Slice(good, func(i, j int) bool { return p.stats[good[i]].duration() < p.stats[good[j]].duration() })
+	sort.Slice(bad, func(i, j int) bool { return p.stats[bad[i]].errorAge() > p.stats[bad[j]].errorAge() })
+
+	half := (len(p.urls) + 1) / 2
+	if half > len(good) {
+		half = len(good)
+	}
+
+	order := make([]string, 0, len(p.urls))
+	order = append(order, good[:half]...)
+	order = append(order, unknown...)
+	order = append(order, good[half:]...)
+	order = append(order, bad...)
+	return order
+}
+
+// record updates url's health stats with the outcome of one attempt. A
+// context.Canceled error means the attempt lost a hedge race (its
+// raceCtx was canceled once another candidate won), not that the
+// upstream is unhealthy, so it is not recorded as a failure.
+func (p *TransformPool) record(url string, d time.Duration, err error) {
+	st := p.stats[url]
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		st.recordFailure()
+		return
+	}
+	st.recordSuccess(d)
+}
+
+// Healthz returns a per-upstream snapshot of success/fail counters and
+// p50/p95 latency, suitable for exposing on /healthz.
+func (p *TransformPool) Healthz() []upstreamSnapshot {
+	out := make([]upstreamSnapshot, 0, len(p.urls))
+	for _, u := range p.urls {
+		out = append(out, p.stats[u].snapshot(u, p.staleAfter))
+	}
+	return out
+}
+
+// callTransformPool races the pool's ordered candidates: it dispatches to
+// the leader, hedges to the next candidate after hedgeAfter if the leader
+// hasn't answered, and returns whichever attempt finishes successfully
+// first, canceling the rest.
+func (app *proxyApp) callTransformPool(ctx context.Context, payload transformRequest) (transformResponse, error) {
+	pool := app.transformPool
+	candidates := pool.pick()
+
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attemptResult struct {
+		url  string
+		resp transformResponse
+		err  error
+	}
+	resultCh := make(chan attemptResult, len(candidates))
+
+	launched := 0
+	launchNext := func() bool {
+		if launched >= len(candidates) {
+			return false
+		}
+		url := candidates[launched]
+		launched++
+		go func() {
+			start := time.Now()
+			resp, err := app.callTransform(raceCtx, url, payload)
+			pool.record(url, time.Since(start), err)
+			select {
+			case resultCh <- attemptResult{url: url, resp: resp, err: err}:
+			case <-raceCtx.Done():
+			}
+		}()
+		return true
+	}
+
+	launchNext()
+	hedge := time.NewTimer(pool.hedgeAfter)
+	defer hedge.Stop()
+
+	var lastErr error
+	pending := 1
+	for pending > 0 {
+		select {
+		case res := <-resultCh:
+			pending--
+			if res.err == nil {
+				return res.resp, nil
+			}
+			lastErr = fmt.Errorf("upstream %s: %w", res.url, res.err)
+			if launchNext() {
+				pending++
+				if !hedge.Stop() {
+					select {
+					case <-hedge.C:
+					default:
+					}
+				}
+				hedge.Reset(pool.hedgeAfter)
+			}
+		case <-hedge.C:
+			if launchNext() {
+				pending++
+				hedge.Reset(pool.hedgeAfter)
+			}
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no transform upstreams available")
+	}
+	return transformResponse{}, lastErr
+}